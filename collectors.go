@@ -0,0 +1,247 @@
+// Copyright 2016-2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// Scraper is an opt-in collector for a ProxySQL admin table, on top of the
+// stats_mysql_global/stats_mysql_connection_pool scrapes the Exporter always runs.
+type Scraper interface {
+	// Name identifies the Scraper for the -collect.<name> flag and the
+	// scrape_errors_total "collector" label.
+	Name() string
+	// Scrape collects metrics from db into ch, with constLabels attached to every metric.
+	Scrape(db *sql.DB, ch chan<- prometheus.Metric, constLabels prometheus.Labels) error
+}
+
+// queryDigestScraper collects from stats_mysql_query_digest, keyed by
+// (hostgroup, schemaname, digest). TopN, if positive, bounds the number of
+// digests kept per scrape to the TopN by count_star, to limit label cardinality.
+type queryDigestScraper struct {
+	TopN int
+}
+
+func (s *queryDigestScraper) Name() string { return "mysql_query_digest" }
+
+const mySQLQueryDigestQuery = "SELECT hostgroup, schemaname, digest, count_star, sum_time, min_time, max_time, rows_affected, rows_sent " +
+	"FROM stats_mysql_query_digest ORDER BY count_star DESC"
+
+func (s *queryDigestScraper) Scrape(db *sql.DB, ch chan<- prometheus.Metric, constLabels prometheus.Labels) error {
+	query := mySQLQueryDigestQuery
+	if s.TopN > 0 {
+		query = fmt.Sprintf("%s LIMIT %d", query, s.TopN)
+	}
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	labelNames := []string{"hostgroup", "schemaname", "digest"}
+	var hostgroup, schemaname, digest string
+	var countStar, rowsAffected, rowsSent int64
+	var sumTime, minTime, maxTime float64
+	for rows.Next() {
+		if err = rows.Scan(&hostgroup, &schemaname, &digest, &countStar, &sumTime, &minTime, &maxTime, &rowsAffected, &rowsSent); err != nil {
+			return err
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(prometheus.BuildFQName(namespace, "query_digest", "count_total"),
+				"Total number of times this digest was executed.", labelNames, constLabels),
+			prometheus.CounterValue, float64(countStar), hostgroup, schemaname, digest,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(prometheus.BuildFQName(namespace, "query_digest", "sum_time_seconds_total"),
+				"Total time spent executing this digest.", labelNames, constLabels),
+			prometheus.CounterValue, sumTime/1e6, hostgroup, schemaname, digest,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(prometheus.BuildFQName(namespace, "query_digest", "min_time_seconds"),
+				"Minimum execution time seen for this digest.", labelNames, constLabels),
+			prometheus.GaugeValue, minTime/1e6, hostgroup, schemaname, digest,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(prometheus.BuildFQName(namespace, "query_digest", "max_time_seconds"),
+				"Maximum execution time seen for this digest.", labelNames, constLabels),
+			prometheus.GaugeValue, maxTime/1e6, hostgroup, schemaname, digest,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(prometheus.BuildFQName(namespace, "query_digest", "rows_affected_total"),
+				"Total number of rows affected by this digest.", labelNames, constLabels),
+			prometheus.CounterValue, float64(rowsAffected), hostgroup, schemaname, digest,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(prometheus.BuildFQName(namespace, "query_digest", "rows_sent_total"),
+				"Total number of rows sent to clients by this digest.", labelNames, constLabels),
+			prometheus.CounterValue, float64(rowsSent), hostgroup, schemaname, digest,
+		)
+	}
+	return rows.Err()
+}
+
+// commandsCountersScraper collects from stats_mysql_commands_counters, one
+// execution-time histogram and error counter per MySQL command.
+type commandsCountersScraper struct{}
+
+func (s *commandsCountersScraper) Name() string { return "mysql_commands_counters" }
+
+const mySQLCommandsCountersQuery = "SELECT Command, Total_Time_us, Total_cnt, cnt_100us, cnt_500us, cnt_1ms, cnt_5ms, cnt_10ms, " +
+	"cnt_50ms, cnt_100ms, cnt_500ms, cnt_1s, cnt_5s, cnt_10s, cnt_INFs, cnt_ERR FROM stats_mysql_commands_counters"
+
+// commandsCountersBuckets are the upper bounds, in seconds, of the cumulative cnt_* columns.
+//
+// Per ProxySQL's stats_mysql_commands_counters documentation, each cnt_* column counts
+// commands whose execution time was *below* that column's threshold (i.e. already
+// cumulative, matching the "le" semantics MustNewConstHistogram expects), not the count
+// falling strictly between the previous and current threshold. cnt_INFs (commands at or
+// above the largest threshold) is read but intentionally not fed into buckets: Total_cnt,
+// passed as the histogram's overall count, already covers it as the implicit +Inf bucket.
+var commandsCountersBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+func (s *commandsCountersScraper) Scrape(db *sql.DB, ch chan<- prometheus.Metric, constLabels prometheus.Labels) error {
+	rows, err := db.Query(mySQLCommandsCountersQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	labelNames := []string{"command"}
+	var command string
+	var totalTimeUs, totalCnt, cntErr int64
+	var cnt100us, cnt500us, cnt1ms, cnt5ms, cnt10ms, cnt50ms, cnt100ms, cnt500ms, cnt1s, cnt5s, cnt10s, cntINFs int64
+	for rows.Next() {
+		if err = rows.Scan(&command, &totalTimeUs, &totalCnt,
+			&cnt100us, &cnt500us, &cnt1ms, &cnt5ms, &cnt10ms, &cnt50ms, &cnt100ms, &cnt500ms, &cnt1s, &cnt5s, &cnt10s, &cntINFs, &cntErr); err != nil {
+			return err
+		}
+		command = strings.ToLower(command)
+
+		buckets := map[float64]uint64{
+			commandsCountersBuckets[0]:  uint64(cnt100us),
+			commandsCountersBuckets[1]:  uint64(cnt500us),
+			commandsCountersBuckets[2]:  uint64(cnt1ms),
+			commandsCountersBuckets[3]:  uint64(cnt5ms),
+			commandsCountersBuckets[4]:  uint64(cnt10ms),
+			commandsCountersBuckets[5]:  uint64(cnt50ms),
+			commandsCountersBuckets[6]:  uint64(cnt100ms),
+			commandsCountersBuckets[7]:  uint64(cnt500ms),
+			commandsCountersBuckets[8]:  uint64(cnt1s),
+			commandsCountersBuckets[9]:  uint64(cnt5s),
+			commandsCountersBuckets[10]: uint64(cnt10s),
+		}
+		ch <- prometheus.MustNewConstHistogram(
+			prometheus.NewDesc(prometheus.BuildFQName(namespace, "mysql_commands", "duration_seconds"),
+				"Execution time of this MySQL command, as tracked by stats_mysql_commands_counters.", labelNames, constLabels),
+			uint64(totalCnt), float64(totalTimeUs)/1e6, buckets, command,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(prometheus.BuildFQName(namespace, "mysql_commands", "errors_total"),
+				"Total number of errors executing this MySQL command.", labelNames, constLabels),
+			prometheus.CounterValue, float64(cntErr), command,
+		)
+	}
+	return rows.Err()
+}
+
+// memoryMetricsScraper collects from stats_memory_metrics, a table of
+// Variable_Name/Variable_Value pairs shaped like stats_mysql_global.
+type memoryMetricsScraper struct{}
+
+func (s *memoryMetricsScraper) Name() string { return "memory_metrics" }
+
+const memoryMetricsQuery = "SELECT Variable_Name, Variable_Value FROM stats_memory_metrics"
+
+func (s *memoryMetricsScraper) Scrape(db *sql.DB, ch chan<- prometheus.Metric, constLabels prometheus.Labels) error {
+	rows, err := db.Query(memoryMetricsQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var name, valueS string
+	for rows.Next() {
+		if err = rows.Scan(&name, &valueS); err != nil {
+			return err
+		}
+		value, err := strconv.ParseFloat(valueS, 64)
+		if err != nil {
+			log.Debugf("variable %s: %s", name, err)
+			continue
+		}
+
+		name = strings.ToLower(name)
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(prometheus.BuildFQName(namespace, "memory_metrics", name),
+				"Value of the "+name+" memory metric, from stats_memory_metrics.", nil, constLabels),
+			prometheus.GaugeValue, value,
+		)
+	}
+	return rows.Err()
+}
+
+// statsMySQLUsersScraper collects from stats_mysql_users, the current frontend
+// connection counts per ProxySQL user.
+type statsMySQLUsersScraper struct{}
+
+func (s *statsMySQLUsersScraper) Name() string { return "stats_mysql_users" }
+
+const statsMySQLUsersQuery = "SELECT username, frontend_connections, frontend_max_connections FROM stats_mysql_users"
+
+func (s *statsMySQLUsersScraper) Scrape(db *sql.DB, ch chan<- prometheus.Metric, constLabels prometheus.Labels) error {
+	rows, err := db.Query(statsMySQLUsersQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	labelNames := []string{"username"}
+	var username string
+	var frontendConnections, frontendMaxConnections int64
+	for rows.Next() {
+		if err = rows.Scan(&username, &frontendConnections, &frontendMaxConnections); err != nil {
+			return err
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(prometheus.BuildFQName(namespace, "mysql_users", "frontend_connections"),
+				"Current number of frontend connections for this user.", labelNames, constLabels),
+			prometheus.GaugeValue, float64(frontendConnections), username,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(prometheus.BuildFQName(namespace, "mysql_users", "frontend_max_connections"),
+				"Maximum number of frontend connections allowed for this user.", labelNames, constLabels),
+			prometheus.GaugeValue, float64(frontendMaxConnections), username,
+		)
+	}
+	return rows.Err()
+}
+
+// check interfaces
+var (
+	_ Scraper = (*queryDigestScraper)(nil)
+	_ Scraper = (*commandsCountersScraper)(nil)
+	_ Scraper = (*memoryMetricsScraper)(nil)
+	_ Scraper = (*statsMySQLUsersScraper)(nil)
+)
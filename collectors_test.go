@@ -0,0 +1,179 @@
+// Copyright 2016-2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestQueryDigestScraper(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening a stub database connection: %s", err)
+	}
+	defer db.Close()
+
+	columns := []string{"hostgroup", "schemaname", "digest", "count_star", "sum_time", "min_time", "max_time", "rows_affected", "rows_sent"}
+	rows := sqlmock.NewRows(columns).
+		AddRow("0", "information_schema", "0xABC", "42", "420000", "1000", "20000", "84", "168")
+	mock.ExpectQuery(sanitizeQuery(mySQLQueryDigestQuery + " LIMIT 1")).WillReturnRows(rows)
+
+	ch := make(chan prometheus.Metric)
+	s := &queryDigestScraper{TopN: 1}
+	go func() {
+		if err = s.Scrape(db, ch, nil); err != nil {
+			t.Errorf("error calling Scrape: %s", err)
+		}
+		close(ch)
+	}()
+
+	labels := prometheus.Labels{"hostgroup": "0", "schemaname": "information_schema", "digest": "0xABC"}
+	counterExpected := []metricResult{
+		{"proxysql_query_digest_count_total", labels, 42, dto.MetricType_COUNTER},
+		{"proxysql_query_digest_sum_time_seconds_total", labels, 0.42, dto.MetricType_COUNTER},
+		{"proxysql_query_digest_min_time_seconds", labels, 0.001, dto.MetricType_GAUGE},
+		{"proxysql_query_digest_max_time_seconds", labels, 0.02, dto.MetricType_GAUGE},
+		{"proxysql_query_digest_rows_affected_total", labels, 84, dto.MetricType_COUNTER},
+		{"proxysql_query_digest_rows_sent_total", labels, 168, dto.MetricType_COUNTER},
+	}
+	for _, expect := range counterExpected {
+		got := *readMetric(<-ch)
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("got %+v, expected %+v", got, expect)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCommandsCountersScraper(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening a stub database connection: %s", err)
+	}
+	defer db.Close()
+
+	columns := []string{"Command", "Total_Time_us", "Total_cnt", "cnt_100us", "cnt_500us", "cnt_1ms", "cnt_5ms", "cnt_10ms",
+		"cnt_50ms", "cnt_100ms", "cnt_500ms", "cnt_1s", "cnt_5s", "cnt_10s", "cnt_INFs", "cnt_ERR"}
+	rows := sqlmock.NewRows(columns).
+		AddRow("SELECT", "1000000", "10", "1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "10", "10", "1")
+	mock.ExpectQuery(sanitizeQuery(mySQLCommandsCountersQuery)).WillReturnRows(rows)
+
+	ch := make(chan prometheus.Metric)
+	s := &commandsCountersScraper{}
+	go func() {
+		if err = s.Scrape(db, ch, nil); err != nil {
+			t.Errorf("error calling Scrape: %s", err)
+		}
+		close(ch)
+	}()
+
+	histogramMetric := <-ch
+	pb := &dto.Metric{}
+	if err := histogramMetric.Write(pb); err != nil {
+		t.Fatalf("error writing histogram metric: %s", err)
+	}
+	if name := getName(histogramMetric.Desc()); name != "proxysql_mysql_commands_duration_seconds" {
+		t.Errorf("got metric name %q, expected proxysql_mysql_commands_duration_seconds", name)
+	}
+	if pb.Histogram == nil || pb.Histogram.GetSampleCount() != 10 || pb.Histogram.GetSampleSum() != 1 {
+		t.Errorf("unexpected histogram: %+v", pb.Histogram)
+	}
+
+	errExpected := metricResult{"proxysql_mysql_commands_errors_total", prometheus.Labels{"command": "select"}, 1, dto.MetricType_COUNTER}
+	if got := *readMetric(<-ch); !reflect.DeepEqual(got, errExpected) {
+		t.Errorf("got %+v, expected %+v", got, errExpected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMemoryMetricsScraper(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening a stub database connection: %s", err)
+	}
+	defer db.Close()
+
+	columns := []string{"Variable_Name", "Variable_Value"}
+	rows := sqlmock.NewRows(columns).
+		AddRow("Auth_memory", "4096")
+	mock.ExpectQuery(memoryMetricsQuery).WillReturnRows(rows)
+
+	ch := make(chan prometheus.Metric)
+	s := &memoryMetricsScraper{}
+	go func() {
+		if err = s.Scrape(db, ch, nil); err != nil {
+			t.Errorf("error calling Scrape: %s", err)
+		}
+		close(ch)
+	}()
+
+	expect := metricResult{"proxysql_memory_metrics_auth_memory", prometheus.Labels{}, 4096, dto.MetricType_GAUGE}
+	if got := *readMetric(<-ch); !reflect.DeepEqual(got, expect) {
+		t.Errorf("got %+v, expected %+v", got, expect)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestStatsMySQLUsersScraper(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening a stub database connection: %s", err)
+	}
+	defer db.Close()
+
+	columns := []string{"username", "frontend_connections", "frontend_max_connections"}
+	rows := sqlmock.NewRows(columns).
+		AddRow("root", "3", "100")
+	mock.ExpectQuery(statsMySQLUsersQuery).WillReturnRows(rows)
+
+	ch := make(chan prometheus.Metric)
+	s := &statsMySQLUsersScraper{}
+	go func() {
+		if err = s.Scrape(db, ch, nil); err != nil {
+			t.Errorf("error calling Scrape: %s", err)
+		}
+		close(ch)
+	}()
+
+	labels := prometheus.Labels{"username": "root"}
+	expected := []metricResult{
+		{"proxysql_mysql_users_frontend_connections", labels, 3, dto.MetricType_GAUGE},
+		{"proxysql_mysql_users_frontend_max_connections", labels, 100, dto.MetricType_GAUGE},
+	}
+	for _, expect := range expected {
+		got := *readMetric(<-ch)
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("got %+v, expected %+v", got, expect)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2016-2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// defaultDSNTemplate is used to build a per-target DSN when neither a [target.<target>]
+// section nor -dsn-template supplies one; it reuses the credentials baked into defaultDataSource.
+const defaultDSNTemplate = "stats:stats@tcp(%s)/"
+
+// probeHandler scrapes the ProxySQL instance identified by the "target" query parameter
+// into a fresh registry and serves the result, similar to blackbox_exporter's /probe.
+func probeHandler(w http.ResponseWriter, r *http.Request, mysqlStatus, mysqlConnectionPool bool, scrapers []Scraper) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, `target parameter is missing`, http.StatusBadRequest)
+		return
+	}
+	dsn, err := targetDSN(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	exporter := NewExporter(dsn, mysqlStatus, mysqlConnectionPool, scrapers, prometheus.Labels{"target": target})
+	registry.MustRegister(&probeCollector{exporter: exporter})
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError}).ServeHTTP(w, r)
+}
+
+// probeCollector wraps an Exporter built for a single /probe request so that registering
+// it doesn't pay for Exporter's live-scrape-based Describe (see exporter.go): since the
+// registry is fresh and thrown away after the request, nothing ever consumes its descriptors,
+// so Describe can safely send none rather than running a full, and otherwise redundant, scrape.
+type probeCollector struct {
+	exporter *Exporter
+}
+
+// Describe is intentionally a no-op; see probeCollector.
+func (c *probeCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c *probeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.exporter.Collect(ch)
+}
+
+// check interface
+var _ prometheus.Collector = (*probeCollector)(nil)
+
+// targetRE matches the characters allowed in a "host:port" target: hostname/IPv4 characters,
+// plus "[" and "]" for bracketed IPv6 literals.
+var targetRE = regexp.MustCompile(`^[a-zA-Z0-9.\-\[\]:]+$`)
+
+// validateTarget rejects anything that isn't a plain "host:port" pair, so that target can't
+// be used to inject extra parameters (or close the "tcp(...)" early) into the DSN built by
+// targetDSN.
+func validateTarget(target string) error {
+	if !targetRE.MatchString(target) {
+		return fmt.Errorf("target %q is not a valid host:port pair", target)
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return fmt.Errorf("target %q is not a valid host:port pair: %s", target, err)
+	}
+	return nil
+}
+
+// targetDSN builds the DSN used to scrape target (a "host:port" pair).
+//
+// Authentication is resolved in this order:
+//  1. a [target.<target>] INI section with a "dsn" key, for targets that need their own credentials;
+//  2. -dsn-template (or the "dsn-template" INI key), a DSN containing one %s placeholder for target;
+//  3. defaultDSNTemplate.
+func targetDSN(target string) (string, error) {
+	if err := validateTarget(target); err != nil {
+		return "", err
+	}
+
+	if iniFile != nil {
+		if section, err := iniFile.GetSection("target." + target); err == nil {
+			if dsn := section.Key("dsn").String(); dsn != "" {
+				return withConnectTimeout(dsn, *probeTimeoutF), nil
+			}
+		}
+	}
+
+	tmpl := lookupConfig("dsn-template", *dsnTemplateF).(string)
+	if tmpl == "" {
+		tmpl = defaultDSNTemplate
+	}
+	if strings.Count(tmpl, "%s") != 1 {
+		return "", fmt.Errorf("dsn-template %q must contain exactly one %%s placeholder for the target", tmpl)
+	}
+
+	return withConnectTimeout(fmt.Sprintf(tmpl, target), *probeTimeoutF), nil
+}
+
+// withConnectTimeout appends a go-sql-driver/mysql "timeout" DSN parameter bounding how
+// long the probe handler can spend establishing a connection to the target.
+func withConnectTimeout(dsn string, timeout time.Duration) string {
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	return fmt.Sprintf("%s%stimeout=%s", dsn, sep, timeout)
+}
@@ -0,0 +1,107 @@
+// Copyright 2016-2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+func TestValidateTarget(t *testing.T) {
+	for _, tt := range []struct {
+		target  string
+		wantErr bool
+	}{
+		{"localhost:6032", false},
+		{"10.0.0.1:6032", false},
+		{"[::1]:6032", false},
+		{"proxysql.example.com:6032", false},
+		{"evil.example.com:3306)/mysql?allowAllFiles=true", true},
+		{"localhost:6032/../etc", true},
+		{"localhost:6032@attacker", true},
+		{"localhost 6032", true},
+		{"localhost:6032\nInjected: yes", true},
+		{"", true},
+		{"no-port", true},
+	} {
+		err := validateTarget(tt.target)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateTarget(%q) = %v, wantErr %v", tt.target, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTargetDSNRejectsInvalidTarget(t *testing.T) {
+	if _, err := targetDSN("evil.example.com:3306)/mysql?allowAllFiles=true"); err == nil {
+		t.Error("expected targetDSN to reject a target that isn't a plain host:port pair")
+	}
+}
+
+func TestTargetDSNPrecedence(t *testing.T) {
+	defer func() { iniFile = nil }()
+	defer flag.Set("dsn-template", *dsnTemplateF)
+
+	iniFile = ini.Empty()
+
+	flag.Set("dsn-template", "tmpl:pass@tcp(%s)/")
+	dsn, err := targetDSN("proxysql1:6032")
+	if err != nil {
+		t.Fatalf("targetDSN: %s", err)
+	}
+	if !strings.HasPrefix(dsn, "tmpl:pass@tcp(proxysql1:6032)/") {
+		t.Errorf("targetDSN with -dsn-template set = %q, want it to use the template", dsn)
+	}
+
+	section, err := iniFile.NewSection("target.proxysql2:6032")
+	if err != nil {
+		t.Fatalf("NewSection: %s", err)
+	}
+	section.NewKey("dsn", "override:pass@tcp(proxysql2:6032)/")
+	dsn, err = targetDSN("proxysql2:6032")
+	if err != nil {
+		t.Fatalf("targetDSN: %s", err)
+	}
+	if !strings.HasPrefix(dsn, "override:pass@tcp(proxysql2:6032)/") {
+		t.Errorf("targetDSN for a target with a [target.*] section = %q, want the section's dsn to win over -dsn-template", dsn)
+	}
+}
+
+func TestTargetDSNRejectsBadTemplate(t *testing.T) {
+	defer func() { iniFile = nil }()
+	defer flag.Set("dsn-template", *dsnTemplateF)
+
+	flag.Set("dsn-template", "no-placeholder")
+	if _, err := targetDSN("proxysql1:6032"); err == nil {
+		t.Error("expected targetDSN to reject a dsn-template without exactly one target placeholder")
+	}
+}
+
+func TestWithConnectTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		dsn  string
+		want string
+	}{
+		{"stats:stats@tcp(localhost:6032)/", "stats:stats@tcp(localhost:6032)/?timeout=5s"},
+		{"stats:stats@tcp(localhost:6032)/?parseTime=true", "stats:stats@tcp(localhost:6032)/?parseTime=true&timeout=5s"},
+	} {
+		if got := withConnectTimeout(tt.dsn, 5*time.Second); got != tt.want {
+			t.Errorf("withConnectTimeout(%q) = %q, want %q", tt.dsn, got, tt.want)
+		}
+	}
+}
@@ -17,17 +17,18 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/version"
-	"github.com/shatteredsilicon/exporter_shared"
 	"gopkg.in/ini.v1"
 )
 
@@ -41,18 +42,42 @@ var (
 	configPath     = flag.String("config", "/opt/ss/ssm-client/proxysql_exporter.conf", "Path of config file")
 	listenAddressF = flag.String("web.listen-address", ":42004", "Address to listen on for web interface and telemetry.")
 	telemetryPathF = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+	probePathF     = flag.String("web.probe-path", "/probe", "Path under which to expose the multi-target ProxySQL probe endpoint.")
+	probeTimeoutF  = flag.Duration("web.probe-timeout", 10*time.Second, "Maximum duration before a probe request times out.")
+	dsnTemplateF   = flag.String("dsn-template", "", "DSN template used to build the per-target DSN for the probe endpoint; must contain exactly one %s placeholder for the target's host:port.")
+
+	webConfigFileF = flag.String("web.config.file", "", "Path to a YAML file with tls_server_config/basic_auth_users, "+
+		"following the convention used by other Prometheus exporters. Reloaded on SIGHUP. "+
+		"If unset, -web.ssl-cert-file, -web.ssl-key-file and -web.auth-file are used to synthesize one.")
+
+	sslCertFileF = flag.String("web.ssl-cert-file", "", "Path to SSL certificate file. Ignored if -web.config.file is set.")
+	sslKeyFileF  = flag.String("web.ssl-key-file", "", "Path to SSL key file. Ignored if -web.config.file is set.")
+	authFileF    = flag.String("web.auth-file", "/opt/ss/ssm-client/ssm.yml", "Path to YAML file with server_user, server_password keys for HTTP Basic authentication. Ignored if -web.config.file is set.")
 
 	mysqlStatusF         = flag.Bool("collect.mysql_status", true, "Collect from stats_mysql_global (SHOW MYSQL STATUS).")
 	mysqlConnectionPoolF = flag.Bool("collect.mysql_connection_pool", true, "Collect from stats_mysql_connection_pool.")
+
+	mysqlQueryDigestF      = flag.Bool("collect.mysql_query_digest", false, "Collect from stats_mysql_query_digest.")
+	mysqlQueryDigestTopNF  = flag.Int64("collect.mysql_query_digest.top-n", 100, "Maximum number of digests to keep per scrape, ranked by count_star. 0 means unlimited.")
+	mysqlCommandsCountersF = flag.Bool("collect.mysql_commands_counters", false, "Collect from stats_mysql_commands_counters.")
+	memoryMetricsF         = flag.Bool("collect.memory_metrics", false, "Collect from stats_memory_metrics.")
+	statsMySQLUsersF       = flag.Bool("collect.stats_mysql_users", false, "Collect from stats_mysql_users.")
 )
 
 var cfg = new(config)
 
+// iniFile is the loaded config file, kept around so the probe endpoint can look up
+// per-target sections (e.g. [target.<host:port>]) that aren't modeled by config.
+var iniFile *ini.File
+
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "%s %s exports various ProxySQL metrics in Prometheus format.\n", os.Args[0], version.Version)
 		fmt.Fprintf(os.Stderr, "It uses DATA_SOURCE_NAME environment variable with following format: https://github.com/go-sql-driver/mysql#dsn-data-source-name\n")
 		fmt.Fprintf(os.Stderr, "Default value is %q.\n\n", defaultDataSource)
+		fmt.Fprintf(os.Stderr, "Every flag and config file key can also be set with a PROXYSQL_EXPORTER_ prefixed "+
+			"environment variable (e.g. -web.listen-address becomes PROXYSQL_EXPORTER_WEB_LISTEN_ADDRESS); "+
+			"the lookup order is: flag, environment variable, config file, default.\n\n")
 		fmt.Fprintf(os.Stderr, "Usage: %s [flags]\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Flags:\n")
 		flag.PrintDefaults()
@@ -72,36 +97,68 @@ func main() {
 		os.Exit(0)
 	}
 
-	err := ini.MapTo(cfg, *configPath)
+	var err error
+	iniFile, err = ini.Load(*configPath)
 	if err != nil {
 		log.Fatal(fmt.Sprintf("Load config file %s failed: %s", *configPath, err.Error()))
 	}
-
-	// set flags for exporter_shared server
-	flag.Set("web.ssl-cert-file", lookupConfig("web.ssl-cert-file", "").(string))
-	flag.Set("web.ssl-key-file", lookupConfig("web.ssl-key-file", "").(string))
-	flag.Set("web.auth-file", lookupConfig("web.auth-file", "/opt/ss/ssm-client/ssm.yml").(string))
-
-	dsn := os.Getenv("DATA_SOURCE_NAME")
-	if dsn == "" {
-		dsn = lookupConfig("dsn", "").(string)
-	}
-	if dsn == "" {
-		dsn = defaultDataSource
+	if err = iniFile.MapTo(cfg); err != nil {
+		log.Fatal(fmt.Sprintf("Load config file %s failed: %s", *configPath, err.Error()))
 	}
 
+	dsn := lookupConfig("dsn", defaultDataSource).(string)
+
 	log.Infof("Starting %s %s for %s", program, version.Version, dsn)
 
-	exporter := NewExporter(dsn, lookupConfig("collect.mysql_status", *mysqlStatusF).(bool), lookupConfig("collect.mysql_connection_pool", *mysqlConnectionPoolF).(bool))
+	mysqlStatus := lookupConfig("collect.mysql_status", *mysqlStatusF).(bool)
+	mysqlConnectionPool := lookupConfig("collect.mysql_connection_pool", *mysqlConnectionPoolF).(bool)
+	scrapers := enabledScrapers()
+
+	exporter := NewExporter(dsn, mysqlStatus, mysqlConnectionPool, scrapers, nil)
 	prometheus.MustRegister(exporter)
 
-	exporter_shared.RunServer("ProxySQL", lookupConfig("web.listen-address", *listenAddressF).(string), lookupConfig("web.telemetry-path", *telemetryPathF).(string), promhttp.ContinueOnError)
+	telemetryPath := lookupConfig("web.telemetry-path", *telemetryPathF).(string)
+
+	mux := http.NewServeMux()
+	mux.Handle(telemetryPath, promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError}))
+	mux.HandleFunc(lookupConfig("web.probe-path", *probePathF).(string), func(w http.ResponseWriter, r *http.Request) {
+		probeHandler(w, r, mysqlStatus, mysqlConnectionPool, scrapers)
+	})
+	mux.HandleFunc("/", landingPageHandler(telemetryPath))
+
+	if _, err = loadOrSynthesizeWebConfig(); err != nil {
+		log.Fatal(fmt.Sprintf("Load web config failed: %s", err.Error()))
+	}
+
+	runServer(mux)
+}
+
+// enabledScrapers returns the opt-in Scrapers selected via -collect.* flags/config.
+func enabledScrapers() []Scraper {
+	var scrapers []Scraper
+
+	if lookupConfig("collect.mysql_query_digest", *mysqlQueryDigestF).(bool) {
+		topN := lookupConfig("collect.mysql_query_digest.top-n", *mysqlQueryDigestTopNF).(int64)
+		scrapers = append(scrapers, &queryDigestScraper{TopN: int(topN)})
+	}
+	if lookupConfig("collect.mysql_commands_counters", *mysqlCommandsCountersF).(bool) {
+		scrapers = append(scrapers, &commandsCountersScraper{})
+	}
+	if lookupConfig("collect.memory_metrics", *memoryMetricsF).(bool) {
+		scrapers = append(scrapers, &memoryMetricsScraper{})
+	}
+	if lookupConfig("collect.stats_mysql_users", *statsMySQLUsersF).(bool) {
+		scrapers = append(scrapers, &statsMySQLUsersScraper{})
+	}
+
+	return scrapers
 }
 
 type config struct {
-	Web     webConfig     `ini:"web"`
-	Collect collectConfig `ini:"collect"`
-	DSN     string        `ini:"dsn"`
+	Web         webConfig     `ini:"web"`
+	Collect     collectConfig `ini:"collect"`
+	DSN         string        `ini:"dsn"`
+	DSNTemplate string        `ini:"dsn-template"`
 }
 
 type webConfig struct {
@@ -113,12 +170,17 @@ type webConfig struct {
 }
 
 type collectConfig struct {
-	MysqlStatus         bool `ini:"mysql_status"`
-	MysqlConnectionPool bool `ini:"mysql_connection_pool"`
+	MysqlStatus           bool  `ini:"mysql_status"`
+	MysqlConnectionPool   bool  `ini:"mysql_connection_pool"`
+	MysqlQueryDigest      bool  `ini:"mysql_query_digest"`
+	MysqlQueryDigestTopN  int64 `ini:"mysql_query_digest.top-n"`
+	MysqlCommandsCounters bool  `ini:"mysql_commands_counters"`
+	MemoryMetrics         bool  `ini:"memory_metrics"`
+	StatsMySQLUsers       bool  `ini:"stats_mysql_users"`
 }
 
-// lookupConfig lookup config from flag
-// or config by name, returns nil if none exists.
+// lookupConfig lookup config from flag, environment variable or config file,
+// in that order, by name, returns defaultValue if none exists.
 // name should be in this format -> '[section].[key]'
 func lookupConfig(name string, defaultValue interface{}) interface{} {
 	flagSet, flagValue := lookupFlag(name)
@@ -126,6 +188,10 @@ func lookupConfig(name string, defaultValue interface{}) interface{} {
 		return flagValue
 	}
 
+	if envSet, envValue := lookupEnv(name, defaultValue); envSet {
+		return envValue
+	}
+
 	section := ""
 	key := name
 	if i := strings.Index(name, "."); i > 0 {
@@ -203,6 +269,62 @@ func lookupFlag(name string) (flagSet bool, flagValue interface{}) {
 	return
 }
 
+// envVarName turns a lookupConfig name such as "web.listen-address" into the
+// environment variable PROXYSQL_EXPORTER_WEB_LISTEN_ADDRESS that can override it.
+func envVarName(name string) string {
+	name = strings.Trim(name, ".")
+	name = strings.NewReplacer(".", "_", "-", "_").Replace(name)
+	return "PROXYSQL_EXPORTER_" + strings.ToUpper(name)
+}
+
+// lookupEnv looks up name's environment variable, as named by envVarName, parsing
+// it according to defaultValue's type. DATA_SOURCE_NAME is kept as a backward
+// compatible alias for the "dsn" key, predating the PROXYSQL_EXPORTER_ scheme.
+func lookupEnv(name string, defaultValue interface{}) (envSet bool, envValue interface{}) {
+	raw, ok := os.LookupEnv(envVarName(name))
+	if !ok && strings.Trim(name, ".") == "dsn" {
+		raw, ok = os.LookupEnv("DATA_SOURCE_NAME")
+	}
+	if !ok {
+		return false, nil
+	}
+
+	switch reflect.TypeOf(defaultValue).Kind() {
+	case reflect.Bool:
+		v, err := strconv.ParseBool(raw)
+		if err != nil {
+			log.Errorf("cannot parse %q as bool for %s: %s", raw, name, err)
+			return false, nil
+		}
+		return true, v
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			log.Errorf("cannot parse %q as int for %s: %s", raw, name, err)
+			return false, nil
+		}
+		return true, v
+	case reflect.Float32, reflect.Float64:
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			log.Errorf("cannot parse %q as float for %s: %s", raw, name, err)
+			return false, nil
+		}
+		return true, v
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			log.Errorf("cannot parse %q as uint for %s: %s", raw, name, err)
+			return false, nil
+		}
+		return true, v
+	case reflect.String:
+		return true, raw
+	default:
+		return false, nil
+	}
+}
+
 func configure() error {
 	iniCfg, err := ini.Load(*configPath)
 	if err != nil {
@@ -241,32 +363,36 @@ func configure() error {
 				continue
 			}
 
-			flagSet, flagValue := lookupFlag(fmt.Sprintf("%s.%s", section, key))
-			if !flagSet {
+			name := key
+			if section != "" {
+				name = fmt.Sprintf("%s.%s", section, key)
+			}
+
+			valueSet, value := lookupFlag(name)
+			if !valueSet {
+				valueSet, value = lookupEnv(name, fieldValue.Interface())
+			}
+			if !valueSet {
 				continue
 			}
 
 			if fieldValue.IsValid() && fieldValue.CanSet() {
 				switch fieldValue.Kind() {
 				case reflect.Bool:
-					iniCfg.Section(section).Key(key).SetValue(fmt.Sprintf("%t", flagValue.(bool)))
+					iniCfg.Section(section).Key(key).SetValue(fmt.Sprintf("%t", value.(bool)))
 				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-					iniCfg.Section(section).Key(key).SetValue(fmt.Sprintf("%d", flagValue.(int64)))
+					iniCfg.Section(section).Key(key).SetValue(fmt.Sprintf("%d", value.(int64)))
 				case reflect.Float32, reflect.Float64:
-					iniCfg.Section(section).Key(key).SetValue(fmt.Sprintf("%f", flagValue.(float64)))
+					iniCfg.Section(section).Key(key).SetValue(fmt.Sprintf("%f", value.(float64)))
 				case reflect.String:
-					iniCfg.Section(section).Key(key).SetValue(strconv.Quote(flagValue.(string)))
+					iniCfg.Section(section).Key(key).SetValue(strconv.Quote(value.(string)))
 				case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-					iniCfg.Section(section).Key(key).SetValue(fmt.Sprintf("%d", flagValue.(uint64)))
+					iniCfg.Section(section).Key(key).SetValue(fmt.Sprintf("%d", value.(uint64)))
 				}
 			}
 		}
 	}
 
-	if os.Getenv("DATA_SOURCE_NAME") != "" {
-		iniCfg.Section("").Key("dsn").SetValue(strconv.Quote(os.Getenv("DATA_SOURCE_NAME")))
-	}
-
 	if err = iniCfg.SaveTo(*configPath); err != nil {
 		return err
 	}
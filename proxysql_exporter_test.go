@@ -0,0 +1,117 @@
+// Copyright 2016-2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+func TestEnvVarName(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"web.listen-address", "PROXYSQL_EXPORTER_WEB_LISTEN_ADDRESS"},
+		{"dsn-template", "PROXYSQL_EXPORTER_DSN_TEMPLATE"},
+		{".dsn-template", "PROXYSQL_EXPORTER_DSN_TEMPLATE"},
+		{"collect.mysql_query_digest.top-n", "PROXYSQL_EXPORTER_COLLECT_MYSQL_QUERY_DIGEST_TOP_N"},
+	} {
+		if got := envVarName(tt.name); got != tt.want {
+			t.Errorf("envVarName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLookupEnv(t *testing.T) {
+	defer os.Unsetenv("PROXYSQL_EXPORTER_DSN_TEMPLATE")
+	defer os.Unsetenv("DATA_SOURCE_NAME")
+	defer os.Unsetenv("PROXYSQL_EXPORTER_WEB_PROBE_TIMEOUT")
+
+	os.Setenv("PROXYSQL_EXPORTER_DSN_TEMPLATE", "user:pass@tcp(%s)/")
+	if set, v := lookupEnv("dsn-template", ""); !set || v.(string) != "user:pass@tcp(%s)/" {
+		t.Errorf("lookupEnv(%q) = (%v, %v), want (true, %q)", "dsn-template", set, v, "user:pass@tcp(%s)/")
+	}
+
+	os.Unsetenv("PROXYSQL_EXPORTER_DSN_TEMPLATE")
+	os.Setenv("DATA_SOURCE_NAME", "stats:stats@tcp(127.0.0.1:6032)/")
+	if set, v := lookupEnv("dsn", ""); !set || v.(string) != "stats:stats@tcp(127.0.0.1:6032)/" {
+		t.Errorf("lookupEnv(%q) with DATA_SOURCE_NAME fallback = (%v, %v), want (true, fallback value)", "dsn", set, v)
+	}
+
+	if set, _ := lookupEnv("collect.mysql_status", false); set {
+		t.Errorf("lookupEnv(%q) with no environment variable set should report unset", "collect.mysql_status")
+	}
+
+	os.Setenv("PROXYSQL_EXPORTER_WEB_PROBE_TIMEOUT", "not-a-duration")
+	if set, _ := lookupEnv("web.probe-timeout", int64(0)); set {
+		t.Error("lookupEnv with an unparseable value for its type should report unset")
+	}
+}
+
+// TestLookupConfigPrecedence uses -web.ssl-cert-file, a flag no other test touches, since
+// flag.Set leaves a flag permanently visible to flag.Visit (and thus lookupFlag) for the
+// rest of the test binary's run.
+func TestLookupConfigPrecedence(t *testing.T) {
+	defer os.Unsetenv("PROXYSQL_EXPORTER_WEB_SSL_CERT_FILE")
+	defer flag.Set("web.ssl-cert-file", *sslCertFileF)
+
+	// With neither the flag nor the environment variable set, lookupConfig falls through to
+	// whatever cfg.Web.SSLCertFile currently holds (its ini-loaded value, "" in this test).
+	if got := lookupConfig("web.ssl-cert-file", "default"); got != "" {
+		t.Errorf("lookupConfig with nothing set = %v, want %q", got, "")
+	}
+
+	os.Setenv("PROXYSQL_EXPORTER_WEB_SSL_CERT_FILE", "from-env")
+	if got := lookupConfig("web.ssl-cert-file", "default"); got != "from-env" {
+		t.Errorf("lookupConfig with only env set = %v, want %q", got, "from-env")
+	}
+
+	flag.Set("web.ssl-cert-file", "from-flag")
+	if got := lookupConfig("web.ssl-cert-file", "default"); got != "from-flag" {
+		t.Errorf("lookupConfig with both flag and env set = %v, want flag to win, got %q", got, "from-flag")
+	}
+}
+
+// TestConfigurePersistsTopLevelFlags guards against configure() building a "."-prefixed
+// lookupFlag/lookupEnv name for top-level scalar fields (dsn, dsn-template), which doesn't
+// match the actual flag/env names and so silently drops an explicitly-passed -dsn-template.
+func TestConfigurePersistsTopLevelFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxysql_exporter.conf")
+	if err := os.WriteFile(path, []byte(""), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	defer flag.Set("config", *configPath)
+	defer flag.Set("dsn-template", *dsnTemplateF)
+	flag.Set("config", path)
+	flag.Set("dsn-template", "user:pass@tcp(%s)/")
+
+	if err := configure(); err != nil {
+		t.Fatalf("configure: %s", err)
+	}
+
+	saved, err := ini.Load(path)
+	if err != nil {
+		t.Fatalf("ini.Load: %s", err)
+	}
+	if got := saved.Section("").Key("dsn-template").String(); got != "user:pass@tcp(%s)/" {
+		t.Errorf("configure() persisted dsn-template = %q, want the -dsn-template flag value to be written", got)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2016-2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/common/log"
+	"gopkg.in/yaml.v2"
+)
+
+var landingPage = template.Must(template.New("home").Parse(strings.TrimSpace(`
+<html>
+<head>
+	<title>ProxySQL exporter</title>
+</head>
+<body>
+	<h1>ProxySQL exporter</h1>
+	<p><a href="{{ . }}">Metrics</a></p>
+</body>
+</html>
+`)))
+
+// landingPageHandler serves a simple HTML page linking to the metrics path.
+func landingPageHandler(metricsPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := landingPage.Execute(w, metricsPath); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// basicAuth holds the legacy -web.auth-file credentials.
+type basicAuth struct {
+	Username string `yaml:"server_user,omitempty"`
+	Password string `yaml:"server_password,omitempty"`
+}
+
+// readBasicAuth returns basicAuth from the given file, or an empty one if authFile is "".
+func readBasicAuth(authFile string) *basicAuth {
+	var auth basicAuth
+	if authFile == "" {
+		return &auth
+	}
+
+	b, err := ioutil.ReadFile(authFile)
+	if err != nil {
+		log.Fatalf("cannot read auth file %q: %s", authFile, err)
+	}
+	if err = yaml.Unmarshal(b, &auth); err != nil {
+		log.Fatalf("cannot parse auth file %q: %s", authFile, err)
+	}
+	return &auth
+}
+
+// basicAuthHandler checks username and password, against whatever webConfigFile
+// is currently in effect, before invoking the wrapped handler.
+type basicAuthHandler struct {
+	handler http.Handler
+}
+
+func (h *basicAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg := activeWebConfig()
+	if len(cfg.BasicAuthUsers) == 0 {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok || !cfg.checkBasicAuth(username, password) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	h.handler.ServeHTTP(w, r)
+}
+
+// runServer serves mux on -web.listen-address, wrapped with HTTP Basic Auth and,
+// if configured, TLS, per the webConfigFile loaded by loadOrSynthesizeWebConfig.
+// Function never returns.
+func runServer(mux *http.ServeMux) {
+	addr := lookupConfig("web.listen-address", *listenAddressF).(string)
+	path := lookupConfig("web.telemetry-path", *telemetryPathF).(string)
+
+	srv := &http.Server{Addr: addr, Handler: &basicAuthHandler{handler: mux}}
+
+	if activeWebConfig().hasTLS() {
+		srv.TLSConfig = &tls.Config{
+			// GetConfigForClient (rather than a static Certificates/TLSConfig) lets a
+			// SIGHUP-triggered reload of -web.config.file take effect for new connections
+			// without restarting the listener.
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return buildTLSConfig(activeWebConfig().TLSServerConfig)
+			},
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				cfg, err := buildTLSConfig(activeWebConfig().TLSServerConfig)
+				if err != nil {
+					return nil, err
+				}
+				return &cfg.Certificates[0], nil
+			},
+		}
+		log.Infof("Starting HTTPS server for https://%s%s ...", addr, path)
+		log.Fatal(srv.ListenAndServeTLS("", ""))
+	}
+
+	log.Infof("Starting HTTP server for http://%s%s ...", addr, path)
+	log.Fatal(srv.ListenAndServe())
+}
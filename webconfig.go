@@ -0,0 +1,252 @@
+// Copyright 2016-2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// webConfigFile is the schema of -web.config.file, following the tls_server_config /
+// basic_auth_users convention used by upstream Prometheus exporters (node_exporter,
+// blackbox_exporter, etc).
+type webConfigFile struct {
+	TLSServerConfig tlsServerConfig   `yaml:"tls_server_config"`
+	BasicAuthUsers  map[string]string `yaml:"basic_auth_users"`
+}
+
+// tlsServerConfig configures the server side of TLS.
+type tlsServerConfig struct {
+	CertFile       string   `yaml:"cert_file"`
+	KeyFile        string   `yaml:"key_file"`
+	ClientCAFile   string   `yaml:"client_ca_file"`
+	ClientAuthType string   `yaml:"client_auth_type"`
+	MinVersion     string   `yaml:"min_version"`
+	CipherSuites   []string `yaml:"cipher_suites"`
+}
+
+// currentWebConfig holds the *webConfigFile in effect; it is swapped atomically
+// on SIGHUP so a running server can pick up renewed certificates or credentials
+// without a restart.
+var currentWebConfig atomic.Value
+
+// loadWebConfigFile reads and parses path into a webConfigFile.
+func loadWebConfigFile(path string) (*webConfigFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &webConfigFile{}
+	if err = yaml.UnmarshalStrict(b, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+// synthesizeWebConfig builds an in-memory webConfigFile from the legacy
+// -web.ssl-cert-file, -web.ssl-key-file and -web.auth-file flags/INI keys, so
+// that configurations predating -web.config.file keep working unchanged.
+func synthesizeWebConfig() (*webConfigFile, error) {
+	cfg := &webConfigFile{
+		TLSServerConfig: tlsServerConfig{
+			CertFile: lookupConfig("web.ssl-cert-file", *sslCertFileF).(string),
+			KeyFile:  lookupConfig("web.ssl-key-file", *sslKeyFileF).(string),
+		},
+	}
+
+	authFile := lookupConfig("web.auth-file", *authFileF).(string)
+	if authFile == "" {
+		return cfg, nil
+	}
+
+	auth := readBasicAuth(authFile)
+	if auth.Username == "" && auth.Password == "" {
+		return cfg, nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(auth.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("hashing password from %s: %s", authFile, err)
+	}
+	cfg.BasicAuthUsers = map[string]string{auth.Username: string(hash)}
+	return cfg, nil
+}
+
+// loadOrSynthesizeWebConfig returns the webConfigFile to serve with: the file at
+// -web.config.file if one is configured, or one synthesized from the legacy flags
+// otherwise. If -web.config.file is set, changes are picked up on SIGHUP.
+func loadOrSynthesizeWebConfig() (*webConfigFile, error) {
+	path := *webConfigFileF
+	if path == "" {
+		cfg, err := synthesizeWebConfig()
+		if err != nil {
+			return nil, err
+		}
+		if err := validateTLS(cfg); err != nil {
+			return nil, err
+		}
+		currentWebConfig.Store(cfg)
+		return cfg, nil
+	}
+
+	cfg, err := loadWebConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateTLS(cfg); err != nil {
+		return nil, err
+	}
+	currentWebConfig.Store(cfg)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			reloaded, err := loadWebConfigFile(path)
+			if err != nil {
+				log.Errorf("Error reloading web config file %s: %s", path, err)
+				continue
+			}
+			if err := validateTLS(reloaded); err != nil {
+				log.Errorf("Error reloading web config file %s: %s", path, err)
+				continue
+			}
+			currentWebConfig.Store(reloaded)
+			log.Infof("Reloaded web config file %s", path)
+		}
+	}()
+
+	return cfg, nil
+}
+
+// validateTLS builds, and immediately discards, the tls.Config for cfg's tls_server_config
+// if one is configured, so that a misconfiguration (missing key, unreadable cert, unknown
+// min_version, ...) fails the initial load or a SIGHUP reload loudly instead of surfacing
+// later as an opaque per-handshake TLS error.
+func validateTLS(cfg *webConfigFile) error {
+	if !cfg.hasTLS() {
+		return nil
+	}
+	_, err := buildTLSConfig(cfg.TLSServerConfig)
+	return err
+}
+
+// activeWebConfig returns the webConfigFile currently in effect.
+func activeWebConfig() *webConfigFile {
+	return currentWebConfig.Load().(*webConfigFile)
+}
+
+// checkBasicAuth reports whether username/password match a basic_auth_users entry.
+func (cfg *webConfigFile) checkBasicAuth(username, password string) bool {
+	hash, ok := cfg.BasicAuthUsers[username]
+	if !ok {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// hasTLS reports whether cfg configures a server certificate.
+func (cfg *webConfigFile) hasTLS() bool {
+	return cfg.TLSServerConfig.CertFile != "" || cfg.TLSServerConfig.KeyFile != ""
+}
+
+var tlsVersions = map[string]uint16{
+	"TLS13": tls.VersionTLS13,
+	"TLS12": tls.VersionTLS12,
+	"TLS11": tls.VersionTLS11,
+	"TLS10": tls.VersionTLS10,
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// buildTLSConfig turns a tlsServerConfig into a *tls.Config ready to be used by an http.Server.
+func buildTLSConfig(c tlsServerConfig) (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("tls_server_config requires both cert_file and key_file")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading key pair: %s", err)
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if c.MinVersion != "" {
+		v, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown min_version %q", c.MinVersion)
+		}
+		minVersion = v
+	}
+
+	clientAuth, ok := clientAuthTypes[c.ClientAuthType]
+	if !ok {
+		return nil, fmt.Errorf("unknown client_auth_type %q", c.ClientAuthType)
+	}
+
+	var cipherSuites []uint16
+	if len(c.CipherSuites) > 0 {
+		byName := make(map[string]uint16)
+		for _, s := range tls.CipherSuites() {
+			byName[s.Name] = s.ID
+		}
+		for _, name := range c.CipherSuites {
+			id, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown cipher_suite %q", name)
+			}
+			cipherSuites = append(cipherSuites, id)
+		}
+	}
+
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+		ClientAuth:   clientAuth,
+		CipherSuites: cipherSuites,
+	}
+
+	if c.ClientCAFile != "" {
+		b, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading client_ca_file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in client_ca_file %s", c.ClientCAFile)
+		}
+		tlsCfg.ClientCAs = pool
+	}
+
+	return tlsCfg, nil
+}
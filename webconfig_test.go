@@ -0,0 +1,203 @@
+// Copyright 2016-2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.DefaultCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %s", err)
+	}
+	cfg := &webConfigFile{BasicAuthUsers: map[string]string{"alice": string(hash)}}
+
+	if !cfg.checkBasicAuth("alice", "s3cret") {
+		t.Error("expected correct credentials to be accepted")
+	}
+	if cfg.checkBasicAuth("alice", "wrong") {
+		t.Error("expected wrong password to be rejected")
+	}
+	if cfg.checkBasicAuth("bob", "s3cret") {
+		t.Error("expected unknown user to be rejected")
+	}
+}
+
+func TestBasicAuthHandlerRejectsMissingCredentials(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.DefaultCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %s", err)
+	}
+	currentWebConfig.Store(&webConfigFile{BasicAuthUsers: map[string]string{"alice": string(hash)}})
+
+	called := false
+	h := &basicAuthHandler{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+	if called {
+		t.Error("wrapped handler must not run without valid credentials")
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	req.SetBasicAuth("alice", "s3cret")
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status %d with valid credentials, got %d", http.StatusOK, rec.Code)
+	}
+	if !called {
+		t.Error("wrapped handler should run with valid credentials")
+	}
+}
+
+// genCert writes a self-signed CA-signed leaf certificate (and the CA that signed it) to dir,
+// returning their file paths.
+func genCert(t *testing.T, dir, name string, isCA bool, signer *x509.Certificate, signerKey *ecdsa.PrivateKey) (certPath, keyPath string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:              []string{"127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+
+	parent, parentKey := tmpl, key
+	if signer != nil {
+		parent, parentKey = signer, signerKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %s", err)
+	}
+
+	certPath = filepath.Join(dir, name+".crt")
+	if err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatalf("write cert: %s", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %s", err)
+	}
+	keyPath = filepath.Join(dir, name+".key")
+	if err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("write key: %s", err)
+	}
+
+	return certPath, keyPath, cert, key
+}
+
+func TestBuildTLSConfigRequiresClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxysql_exporter_tls_test")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	caCertPath, _, caCert, caKey := genCert(t, dir, "ca", true, nil, nil)
+	serverCertPath, serverKeyPath, _, _ := genCert(t, dir, "server", false, caCert, caKey)
+	clientCertPath, clientKeyPath, _, _ := genCert(t, dir, "client", false, caCert, caKey)
+
+	tlsCfg, err := buildTLSConfig(tlsServerConfig{
+		CertFile:       serverCertPath,
+		KeyFile:        serverKeyPath,
+		ClientCAFile:   caCertPath,
+		ClientAuthType: "RequireAndVerifyClientCert",
+	})
+	if err != nil {
+		t.Fatalf("buildTLSConfig: %s", err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = tlsCfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	caPool := x509.NewCertPool()
+	caPEM, err := ioutil.ReadFile(caCertPath)
+	if err != nil {
+		t.Fatalf("read CA cert: %s", err)
+	}
+	caPool.AppendCertsFromPEM(caPEM)
+
+	// Without a client certificate, the handshake must fail.
+	noClientCertClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caPool}}}
+	if _, err := noClientCertClient.Get(srv.URL); err == nil {
+		t.Error("expected request without a client certificate to be rejected")
+	}
+
+	// With a valid client certificate signed by the configured CA, the handshake must succeed.
+	clientCert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair: %s", err)
+	}
+	withClientCertClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      caPool,
+		Certificates: []tls.Certificate{clientCert},
+	}}}
+	resp, err := withClientCertClient.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("expected request with a valid client certificate to succeed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+}